@@ -1,11 +1,16 @@
 package setpipelinehelpers
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 
-	yaml "gopkg.in/yaml.v2"
+	yaml "gopkg.in/yaml.v3"
 
 	"github.com/cloudfoundry/bosh-cli/director/template"
 	"github.com/concourse/atc"
@@ -18,13 +23,60 @@ import (
 	"github.com/onsi/gomega/gexec"
 	"github.com/tedsuo/rata"
 	"github.com/vito/go-interact/interact"
+	"go.uber.org/multierr"
 )
 
+// templateVarPattern matches a ((var)) or ((group.subkey)) reference so
+// unresolved vars can be enumerated even when the underlying template
+// library would otherwise stop at the first one.
+var templateVarPattern = regexp.MustCompile(`\(\(([-/\w.]+)\)\)`)
+
+// missingVariablesError distinguishes an aggregated "these vars are
+// missing" failure from any other error newConfig can return, so Set can
+// render it under its own "missing variables:" header.
+type missingVariablesError struct {
+	err error
+}
+
+func (e missingVariablesError) Error() string {
+	return e.err.Error()
+}
+
 type ATCConfig struct {
 	PipelineName        string
 	Team                concourse.Team
 	WebRequestGenerator *rata.RequestGenerator
 	SkipInteraction     bool
+
+	// DryRun renders the pipeline config and prints the diff without ever
+	// calling Team.CreateOrUpdatePipelineConfig.
+	DryRun bool
+	// RenderToFile, when set, writes the fully resolved YAML to this path
+	// instead of stdout. Only consulted when DryRun is true -- rendering
+	// never happens outside of --dry-run.
+	RenderToFile atc.PathFlag
+
+	// DiffFormat selects how the pipeline diff is rendered: "" (or
+	// "text") for the existing human-oriented output, "json" for a
+	// structured document callers can consume programmatically.
+	DiffFormat string
+
+	// VarsFromCommand, if set, resolves template vars not satisfied by
+	// -v/-l by shelling out to this command template (see
+	// CommandSecretProvider). Mutually exclusive with VarsDir.
+	VarsFromCommand string
+	// VarsDir, if set, resolves template vars not satisfied by -v/-l by
+	// reading a file named after the var from this directory (see
+	// DirSecretProvider). Mutually exclusive with VarsFromCommand.
+	VarsDir atc.PathFlag
+	// PrintUsedVars reports, after a successful resolve, which vars were
+	// actually pulled from VarsFromCommand/VarsDir -- useful for
+	// auditing and rotation.
+	PrintUsedVars bool
+
+	// Strict rejects a pipeline config that has unknown top-level keys
+	// instead of silently ignoring them.
+	Strict bool
 }
 
 func (atcConfig ATCConfig) ApplyConfigInteraction() bool {
@@ -42,7 +94,24 @@ func (atcConfig ATCConfig) ApplyConfigInteraction() bool {
 }
 
 func (atcConfig ATCConfig) Set(configPath atc.PathFlag, templateVariables []flaghelpers.VariablePairFlag, templateVariablesFiles []atc.PathFlag) error {
-	newConfig := atcConfig.newConfig(configPath, templateVariablesFiles, templateVariables)
+	if atcConfig.DryRun && atcConfig.DiffFormat == "json" && atcConfig.RenderToFile == "" {
+		return fmt.Errorf("--dry-run cannot be combined with --diff-format=json unless --render-to writes the rendered config to a file instead of stdout")
+	}
+
+	if atcConfig.VarsFromCommand != "" && atcConfig.VarsDir != "" {
+		return fmt.Errorf("--vars-from-command cannot be combined with --vars-dir")
+	}
+
+	newConfig, err := atcConfig.newConfig(configPath, templateVariablesFiles, templateVariables)
+	if err != nil {
+		if missingVars, ok := err.(missingVariablesError); ok {
+			atcConfig.showMissingVariablesError(missingVars.err)
+			return missingVars
+		}
+
+		return fmt.Errorf("could not resolve template vars: %s", err)
+	}
+
 	existingConfig, _, existingConfigVersion, _, err := atcConfig.Team.PipelineConfig(atcConfig.PipelineName)
 	errorMessages := []string{}
 	if err != nil {
@@ -54,17 +123,23 @@ func (atcConfig ATCConfig) Set(configPath atc.PathFlag, templateVariables []flag
 	}
 
 	var new atc.Config
-	err = yaml.Unmarshal([]byte(newConfig), &new)
+	err = decodeConfig(newConfig, string(configPath), atcConfig.Strict, &new)
 	if err != nil {
 		return err
 	}
 
-	diff(existingConfig, new)
+	if err := atcConfig.diff(existingConfig, new); err != nil {
+		return err
+	}
 
 	if len(errorMessages) > 0 {
 		atcConfig.showPipelineConfigErrors(errorMessages)
 	}
 
+	if atcConfig.DryRun {
+		return atcConfig.renderConfig(newConfig)
+	}
+
 	if !atcConfig.ApplyConfigInteraction() {
 		fmt.Println("bailing out")
 		return nil
@@ -87,17 +162,32 @@ func (atcConfig ATCConfig) Set(configPath atc.PathFlag, templateVariables []flag
 	return nil
 }
 
-func (atcConfig ATCConfig) newConfig(configPath atc.PathFlag, templateVariablesFiles []atc.PathFlag, templateVariables []flaghelpers.VariablePairFlag) []byte {
+// renderConfig writes the fully resolved pipeline config to the
+// --render-to file, if one was given, or to stdout otherwise. It never
+// talks to the ATC.
+func (atcConfig ATCConfig) renderConfig(newConfig []byte) error {
+	if atcConfig.RenderToFile == "" {
+		_, err := os.Stdout.Write(newConfig)
+		return err
+	}
+
+	// ioutil.WriteFile opens with O_CREATE, so the process umask is
+	// applied by the kernel the same way it would be for any other tool
+	// writing this file; no extra masking is needed here.
+	return ioutil.WriteFile(string(atcConfig.RenderToFile), newConfig, 0644)
+}
+
+func (atcConfig ATCConfig) newConfig(configPath atc.PathFlag, templateVariablesFiles []atc.PathFlag, templateVariables []flaghelpers.VariablePairFlag) ([]byte, error) {
 	evaluatedConfig, err := ioutil.ReadFile(string(configPath))
 	if err != nil {
-		displayhelpers.FailWithErrorf("could not read config file", err)
+		return nil, fmt.Errorf("could not read config file: %s", err)
 	}
 
 	var paramPayloads [][]byte
 	for _, path := range templateVariablesFiles {
 		templateVars, err := ioutil.ReadFile(string(path))
 		if err != nil {
-			displayhelpers.FailWithErrorf("could not read template variables file (%s)", err, string(path))
+			return nil, fmt.Errorf("could not read template variables file (%s): %s", string(path), err)
 		}
 
 		paramPayloads = append(paramPayloads, templateVars)
@@ -106,16 +196,76 @@ func (atcConfig ATCConfig) newConfig(configPath atc.PathFlag, templateVariablesF
 	if temp.Present(evaluatedConfig) {
 		evaluatedConfig, err = atcConfig.resolveDeprecatedTemplateStyle(evaluatedConfig, paramPayloads, templateVariables)
 		if err != nil {
-			displayhelpers.FailWithErrorf("could not resolve old-style template vars", err)
+			return nil, fmt.Errorf("could not resolve old-style template vars: %s", err)
 		}
 	}
 
 	evaluatedConfig, err = atcConfig.resolveTemplates(evaluatedConfig, paramPayloads, templateVariables)
 	if err != nil {
-		displayhelpers.Failf("could not resolve template vars", err)
+		return nil, err
+	}
+
+	return evaluatedConfig, nil
+}
+
+// knownTopLevelConfigKeys lists the top-level pipeline config sections
+// this package already knows how to diff; --strict rejects anything
+// else rather than silently ignoring a typo'd key.
+var knownTopLevelConfigKeys = map[string]bool{
+	"groups":         true,
+	"resources":      true,
+	"resource_types": true,
+	"jobs":           true,
+}
+
+// decodeConfig parses payload into a yaml.Node tree -- rather than
+// unmarshaling straight into atc.Config -- so --strict can walk the
+// top-level mapping for unrecognized keys, reporting each one's line and
+// column. A parse or decode error is prefixed with the originating file
+// path and otherwise carries only yaml's own message, which names the
+// offending line but not its column.
+func decodeConfig(payload []byte, sourcePath string, strict bool, out *atc.Config) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(payload, &doc); err != nil {
+		return fmt.Errorf("%s: %s", sourcePath, err)
+	}
+
+	if len(doc.Content) == 0 {
+		return nil
+	}
+
+	if strict {
+		if err := checkUnknownTopLevelKeys(doc.Content[0], sourcePath); err != nil {
+			return err
+		}
+	}
+
+	if err := doc.Decode(out); err != nil {
+		return fmt.Errorf("%s: %s", sourcePath, err)
+	}
+
+	return nil
+}
+
+func checkUnknownTopLevelKeys(mapping *yaml.Node, sourcePath string) error {
+	if mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	var unknownErrs error
+	for i := 0; i < len(mapping.Content); i += 2 {
+		key := mapping.Content[i]
+		if knownTopLevelConfigKeys[key.Value] {
+			continue
+		}
+
+		unknownErrs = multierr.Append(unknownErrs, fmt.Errorf(
+			"%s:%d:%d: unknown top-level key %q",
+			sourcePath, key.Line, key.Column, key.Value,
+		))
 	}
 
-	return evaluatedConfig
+	return unknownErrs
 }
 
 func (atcConfig ATCConfig) resolveTemplates(configPayload []byte, paramPayloads [][]byte, variables []flaghelpers.VariablePairFlag) ([]byte, error) {
@@ -126,6 +276,7 @@ func (atcConfig ATCConfig) resolveTemplates(configPayload []byte, paramPayloads
 		flagVars[f.Name] = f.Value
 	}
 
+	var unmarshalErrs error
 	vars := []template.Variables{flagVars}
 	for i := len(paramPayloads) - 1; i >= 0; i-- {
 		payload := paramPayloads[i]
@@ -133,33 +284,122 @@ func (atcConfig ATCConfig) resolveTemplates(configPayload []byte, paramPayloads
 		var staticVars template.StaticVariables
 		err := yaml.Unmarshal(payload, &staticVars)
 		if err != nil {
-			return nil, err
+			unmarshalErrs = multierr.Append(unmarshalErrs, err)
+			continue
 		}
 
 		vars = append(vars, staticVars)
 	}
+	if unmarshalErrs != nil {
+		return nil, unmarshalErrs
+	}
+
+	// A secret provider is only consulted for keys the static vars above
+	// don't already satisfy: MultiVars tries each Variables in order and
+	// stops at the first one that resolves a key, so appending it last
+	// gives -v/-l flags and -l files priority.
+	var secretVars *secretProviderVariables
+	switch {
+	case atcConfig.VarsFromCommand != "":
+		secretVars = newSecretProviderVariables(CommandSecretProvider{CommandTemplate: atcConfig.VarsFromCommand})
+		vars = append(vars, secretVars)
+	case atcConfig.VarsDir != "":
+		secretVars = newSecretProviderVariables(DirSecretProvider{Dir: string(atcConfig.VarsDir)})
+		vars = append(vars, secretVars)
+	}
+
+	multiVars := template.NewMultiVars(vars)
+
+	// Evaluate once without bailing on the first missing key, then scan
+	// the payload for every reference vars can't satisfy (including a
+	// ((group.subkey)) reference the library considers satisfied by a
+	// partial group) and report them all in one pass. The library's own
+	// error (e.g. ExpectAllVars catching a var with no provider at all)
+	// is only reported when the scan finds nothing missing.
+	_, evalErr := tpl.Evaluate(multiVars, nil, template.EvaluateOpts{
+		ExpectAllKeys: false,
+		ExpectAllVars: true,
+	})
+
+	var missingErrs error
+	for _, ref := range missingVariableNames(configPayload, multiVars) {
+		missingErrs = multierr.Append(missingErrs, fmt.Errorf("((%s)) not found", ref))
+	}
+	if missingErrs == nil && evalErr != nil {
+		missingErrs = evalErr
+	}
+	if missingErrs != nil {
+		return nil, missingVariablesError{missingErrs}
+	}
 
-	bytes, err := tpl.Evaluate(template.NewMultiVars(vars), nil, template.EvaluateOpts{
+	bytes, err := tpl.Evaluate(multiVars, nil, template.EvaluateOpts{
 		ExpectAllKeys: true,
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	if atcConfig.PrintUsedVars && secretVars != nil {
+		atcConfig.showUsedVars(secretVars.UsedVars())
+	}
+
 	return bytes, nil
 }
 
+// missingVariableNames scans configPayload for every ((var)) or
+// ((group.subkey)) reference and returns the ones vars can't satisfy,
+// deduplicated and sorted for stable output.
+func missingVariableNames(configPayload []byte, vars template.Variables) []string {
+	seen := map[string]bool{}
+	var missing []string
+
+	for _, match := range templateVarPattern.FindAllSubmatch(configPayload, -1) {
+		ref := string(match[1])
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+
+		segs := strings.Split(ref, ".")
+		val, found, err := vars.Get(template.VariableDefinition{Name: segs[0]})
+		for _, seg := range segs[1:] {
+			if err != nil || !found {
+				break
+			}
+			switch m := val.(type) {
+			case map[string]interface{}:
+				val, found = m[seg]
+			case map[interface{}]interface{}:
+				val, found = m[seg]
+			default:
+				found = false
+			}
+		}
+		if err != nil || !found {
+			missing = append(missing, ref)
+		}
+	}
+
+	sort.Strings(missing)
+	return missing
+}
+
 func (atcConfig ATCConfig) resolveDeprecatedTemplateStyle(configPayload []byte, paramPayloads [][]byte, variables []flaghelpers.VariablePairFlag) ([]byte, error) {
 	vars := temp.Variables{}
+	var errs error
 	for _, payload := range paramPayloads {
 		var payloadVars temp.Variables
 		err := yaml.Unmarshal(payload, &payloadVars)
 		if err != nil {
-			return nil, err
+			errs = multierr.Append(errs, err)
+			continue
 		}
 
 		vars = vars.Merge(payloadVars)
 	}
+	if errs != nil {
+		return nil, errs
+	}
 
 	flagVars := temp.Variables{}
 	for _, flag := range variables {
@@ -183,6 +423,32 @@ func (atcConfig ATCConfig) showPipelineConfigErrors(errorMessages []string) {
 	fmt.Fprintln(ui.Stderr, "")
 }
 
+func (atcConfig ATCConfig) showMissingVariablesError(err error) {
+	fmt.Fprintln(ui.Stderr, "")
+	displayhelpers.PrintWarningHeader()
+
+	fmt.Fprintln(ui.Stderr, "missing variables:")
+	for _, varErr := range multierr.Errors(err) {
+		fmt.Fprintf(ui.Stderr, "  - %s\n", varErr)
+	}
+
+	fmt.Fprintln(ui.Stderr, "")
+}
+
+func (atcConfig ATCConfig) showUsedVars(names []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	fmt.Fprintln(ui.Stderr, "")
+	fmt.Fprintln(ui.Stderr, "used external vars:")
+	for _, name := range names {
+		fmt.Fprintf(ui.Stderr, "  - %s\n", name)
+	}
+
+	fmt.Fprintln(ui.Stderr, "")
+}
+
 func (atcConfig ATCConfig) showWarnings(warnings []concourse.ConfigWarning) {
 	fmt.Fprintln(ui.Stderr, "")
 	displayhelpers.PrintDeprecationWarningHeader()
@@ -224,42 +490,173 @@ func (atcConfig ATCConfig) showHelpfulMessage(created bool, updated bool) {
 	}
 }
 
-func diff(existingConfig atc.Config, newConfig atc.Config) {
+// pipelineDiff holds the per-section diffs between an existing and a
+// candidate pipeline config, shared by both the text and JSON renderers.
+type pipelineDiff struct {
+	groups        []Diff
+	resources     []Diff
+	resourceTypes []Diff
+	jobs          []Diff
+}
+
+// pipelineDiffDocument is the --diff-format=json document shape: one
+// array per section, each entry describing an added, removed, or
+// changed config block.
+type pipelineDiffDocument struct {
+	Groups        []DiffEvent `json:"groups,omitempty"`
+	Resources     []DiffEvent `json:"resources,omitempty"`
+	ResourceTypes []DiffEvent `json:"resource_types,omitempty"`
+	Jobs          []DiffEvent `json:"jobs,omitempty"`
+}
+
+// GroupIndex indexes groups by name so diffIndices can match them up
+// across the existing and candidate pipeline configs.
+func GroupIndex(groups []atc.GroupConfig) map[string]interface{} {
+	idx := make(map[string]interface{}, len(groups))
+	for _, g := range groups {
+		idx[g.Name] = g
+	}
+
+	return idx
+}
+
+// ResourceIndex indexes resources by name so diffIndices can match them
+// up across the existing and candidate pipeline configs.
+func ResourceIndex(resources atc.ResourceConfigs) map[string]interface{} {
+	idx := make(map[string]interface{}, len(resources))
+	for _, r := range resources {
+		idx[r.Name] = r
+	}
+
+	return idx
+}
+
+// ResourceTypeIndex indexes resource types by name so diffIndices can
+// match them up across the existing and candidate pipeline configs.
+func ResourceTypeIndex(resourceTypes atc.ResourceTypes) map[string]interface{} {
+	idx := make(map[string]interface{}, len(resourceTypes))
+	for _, rt := range resourceTypes {
+		idx[rt.Name] = rt
+	}
+
+	return idx
+}
+
+// JobIndex indexes jobs by name so diffIndices can match them up across
+// the existing and candidate pipeline configs.
+func JobIndex(jobs atc.JobConfigs) map[string]interface{} {
+	idx := make(map[string]interface{}, len(jobs))
+	for _, j := range jobs {
+		idx[j.Name] = j
+	}
+
+	return idx
+}
+
+// diffIndices compares two name-indexed maps of config blocks -- built
+// by GroupIndex/ResourceIndex/ResourceTypeIndex/JobIndex above -- and
+// returns a Diff for every block that was added, removed, or changed
+// between them.
+func diffIndices(existing map[string]interface{}, new map[string]interface{}) []Diff {
+	names := map[string]bool{}
+	for name := range existing {
+		names[name] = true
+	}
+	for name := range new {
+		names[name] = true
+	}
+
+	sortedNames := make([]string, 0, len(names))
+	for name := range names {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+
+	var diffs []Diff
+	for _, name := range sortedNames {
+		oldBlock, hadOld := existing[name]
+		newBlock, hasNew := new[name]
+
+		switch {
+		case !hadOld:
+			diffs = append(diffs, Diff{Name: name, Op: DiffAdded, After: newBlock})
+		case !hasNew:
+			diffs = append(diffs, Diff{Name: name, Op: DiffRemoved, Before: oldBlock})
+		case !reflect.DeepEqual(oldBlock, newBlock):
+			diffs = append(diffs, Diff{Name: name, Op: DiffChanged, Before: oldBlock, After: newBlock})
+		}
+	}
+
+	return diffs
+}
+
+func (atcConfig ATCConfig) diff(existingConfig atc.Config, newConfig atc.Config) error {
+	pd := pipelineDiff{
+		groups:        diffIndices(GroupIndex(existingConfig.Groups), GroupIndex(newConfig.Groups)),
+		resources:     diffIndices(ResourceIndex(existingConfig.Resources), ResourceIndex(newConfig.Resources)),
+		resourceTypes: diffIndices(ResourceTypeIndex(existingConfig.ResourceTypes), ResourceTypeIndex(newConfig.ResourceTypes)),
+		jobs:          diffIndices(JobIndex(existingConfig.Jobs), JobIndex(newConfig.Jobs)),
+	}
+
+	if atcConfig.DiffFormat == "json" {
+		return renderDiffJSON(pd)
+	}
+
+	renderDiffText(pd)
+	return nil
+}
+
+func renderDiffText(pd pipelineDiff) {
 	indent := gexec.NewPrefixedWriter("  ", os.Stdout)
 
-	groupDiffs := diffIndices(GroupIndex(existingConfig.Groups), GroupIndex(newConfig.Groups))
-	if len(groupDiffs) > 0 {
+	if len(pd.groups) > 0 {
 		fmt.Println("groups:")
 
-		for _, diff := range groupDiffs {
-			diff.Render(indent, "group")
+		for _, d := range pd.groups {
+			d.Render(indent, "group")
 		}
 	}
 
-	resourceDiffs := diffIndices(ResourceIndex(existingConfig.Resources), ResourceIndex(newConfig.Resources))
-	if len(resourceDiffs) > 0 {
+	if len(pd.resources) > 0 {
 		fmt.Println("resources:")
 
-		for _, diff := range resourceDiffs {
-			diff.Render(indent, "resource")
+		for _, d := range pd.resources {
+			d.Render(indent, "resource")
 		}
 	}
 
-	resourceTypeDiffs := diffIndices(ResourceTypeIndex(existingConfig.ResourceTypes), ResourceTypeIndex(newConfig.ResourceTypes))
-	if len(resourceTypeDiffs) > 0 {
+	if len(pd.resourceTypes) > 0 {
 		fmt.Println("resource types:")
 
-		for _, diff := range resourceTypeDiffs {
-			diff.Render(indent, "resource type")
+		for _, d := range pd.resourceTypes {
+			d.Render(indent, "resource type")
 		}
 	}
 
-	jobDiffs := diffIndices(JobIndex(existingConfig.Jobs), JobIndex(newConfig.Jobs))
-	if len(jobDiffs) > 0 {
+	if len(pd.jobs) > 0 {
 		fmt.Println("jobs:")
 
-		for _, diff := range jobDiffs {
-			diff.Render(indent, "job")
+		for _, d := range pd.jobs {
+			d.Render(indent, "job")
 		}
 	}
 }
+
+func renderDiffJSON(pd pipelineDiff) error {
+	doc := pipelineDiffDocument{
+		Groups:        asDiffEvents(pd.groups),
+		Resources:     asDiffEvents(pd.resources),
+		ResourceTypes: asDiffEvents(pd.resourceTypes),
+		Jobs:          asDiffEvents(pd.jobs),
+	}
+
+	return json.NewEncoder(os.Stdout).Encode(doc)
+}
+
+func asDiffEvents(diffs []Diff) []DiffEvent {
+	events := make([]DiffEvent, len(diffs))
+	for i, d := range diffs {
+		events[i] = d.AsEvent()
+	}
+	return events
+}
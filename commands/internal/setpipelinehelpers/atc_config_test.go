@@ -0,0 +1,114 @@
+package setpipelinehelpers
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry/bosh-cli/director/template"
+)
+
+type fakeVars map[string]interface{}
+
+func (f fakeVars) Get(varDef template.VariableDefinition) (interface{}, bool, error) {
+	v, found := f[varDef.Name]
+	return v, found, nil
+}
+
+func (f fakeVars) List() ([]template.VariableDefinition, error) {
+	return nil, nil
+}
+
+func TestMissingVariableNames(t *testing.T) {
+	payload := []byte(`
+resources:
+- name: r
+  source:
+    uri: ((repo.url))
+    branch: ((branch))
+    again: ((repo.url))
+`)
+
+	vars := fakeVars{"repo": map[string]interface{}{"url": "https://example.com"}}
+
+	missing := missingVariableNames(payload, vars)
+	sort.Strings(missing)
+
+	expected := []string{"branch"}
+	if !reflect.DeepEqual(missing, expected) {
+		t.Fatalf("expected %v, got %v", expected, missing)
+	}
+}
+
+func TestMissingVariableNamesNoneMissing(t *testing.T) {
+	payload := []byte(`source: {uri: ((repo))}`)
+	vars := fakeVars{"repo": "https://example.com"}
+
+	missing := missingVariableNames(payload, vars)
+	if len(missing) != 0 {
+		t.Fatalf("expected no missing vars, got %v", missing)
+	}
+}
+
+func TestSetRejectsDryRunWithJSONDiffFormatToStdout(t *testing.T) {
+	atcConfig := ATCConfig{
+		DryRun:     true,
+		DiffFormat: "json",
+	}
+
+	err := atcConfig.Set("some-config.yml", nil, nil)
+	if err == nil {
+		t.Fatal("expected an error combining --dry-run with --diff-format=json, got none")
+	}
+}
+
+func TestSetAllowsDryRunWithJSONDiffFormatWhenRenderingToFile(t *testing.T) {
+	atcConfig := ATCConfig{
+		DryRun:       true,
+		DiffFormat:   "json",
+		RenderToFile: "rendered.yml",
+	}
+
+	err := atcConfig.Set("missing-config.yml", nil, nil)
+	if err == nil || strings.Contains(err.Error(), "cannot be combined") {
+		t.Fatalf("expected the --render-to case to proceed past the conflict check, got %v", err)
+	}
+}
+
+func TestDiffIndicesAddedRemovedChanged(t *testing.T) {
+	existing := map[string]interface{}{
+		"removed": "old-removed",
+		"changed": "old-changed",
+		"same":    "unchanged",
+	}
+	new := map[string]interface{}{
+		"added":   "new-added",
+		"changed": "new-changed",
+		"same":    "unchanged",
+	}
+
+	diffs := diffIndices(existing, new)
+
+	if len(diffs) != 3 {
+		t.Fatalf("expected 3 diffs, got %d: %+v", len(diffs), diffs)
+	}
+
+	byName := map[string]Diff{}
+	for _, d := range diffs {
+		byName[d.Name] = d
+	}
+
+	if d, ok := byName["added"]; !ok || d.Op != DiffAdded || d.After != "new-added" {
+		t.Fatalf("expected added diff for %q, got %+v (present=%v)", "added", d, ok)
+	}
+	if d, ok := byName["removed"]; !ok || d.Op != DiffRemoved || d.Before != "old-removed" {
+		t.Fatalf("expected removed diff for %q, got %+v (present=%v)", "removed", d, ok)
+	}
+	if d, ok := byName["changed"]; !ok || d.Op != DiffChanged || d.Before != "old-changed" || d.After != "new-changed" {
+		t.Fatalf("expected changed diff for %q, got %+v (present=%v)", "changed", d, ok)
+	}
+	if _, ok := byName["same"]; ok {
+		t.Fatalf("expected no diff for unchanged entry, got %+v", byName["same"])
+	}
+}
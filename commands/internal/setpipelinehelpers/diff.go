@@ -0,0 +1,179 @@
+package setpipelinehelpers
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// DiffOp describes how a named config block differs between the
+// existing and the candidate pipeline.
+type DiffOp string
+
+const (
+	DiffAdded   DiffOp = "added"
+	DiffRemoved DiffOp = "removed"
+	DiffChanged DiffOp = "changed"
+)
+
+// Diff describes how a single named config block (a group, resource,
+// resource type, or job) differs between the existing and the candidate
+// pipeline config. Before/After hold the raw atc.* value for that block
+// and are nil on the side that doesn't have it (added/removed).
+type Diff struct {
+	Name   string
+	Op     DiffOp
+	Before interface{}
+	After  interface{}
+}
+
+// DiffEvent is the --diff-format=json representation of a Diff.
+type DiffEvent struct {
+	Name   string      `json:"name"`
+	Op     string      `json:"op"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// AsEvent converts a Diff into its JSON-friendly representation so
+// callers can compute their own field-level diffs from Before/After.
+func (d Diff) AsEvent() DiffEvent {
+	return DiffEvent{
+		Name:   d.Name,
+		Op:     string(d.Op),
+		Before: d.Before,
+		After:  d.After,
+	}
+}
+
+// Render writes a human-oriented description of the diff to w, labelled
+// with the given config block kind (e.g. "group", "resource").
+func (d Diff) Render(w io.Writer, label string) {
+	switch d.Op {
+	case DiffAdded:
+		fmt.Fprintf(w, "%s %s has been added:\n", label, d.Name)
+	case DiffRemoved:
+		fmt.Fprintf(w, "%s %s has been removed:\n", label, d.Name)
+	default:
+		fmt.Fprintf(w, "%s %s has changed:\n", label, d.Name)
+		renderChangedFields(w, d.Before, d.After)
+	}
+}
+
+// renderChangedFields reports only the child keys that actually changed
+// between before and after -- e.g. a resource's source.branch -- rather
+// than dumping the whole block. It works by round-tripping both sides
+// through a yaml.Node tree (rather than diffing the Go values directly)
+// so the same logic applies uniformly to groups, resources, resource
+// types, and jobs without needing to know their concrete atc.* shape.
+func renderChangedFields(w io.Writer, before interface{}, after interface{}) {
+	beforeNode, beforeErr := toYAMLNode(before)
+	afterNode, afterErr := toYAMLNode(after)
+
+	if beforeErr != nil || afterErr != nil {
+		fmt.Fprintf(w, "  before: %+v\n", before)
+		fmt.Fprintf(w, "  after: %+v\n", after)
+		return
+	}
+
+	changes := diffNodes("", beforeNode, afterNode)
+	if len(changes) == 0 {
+		return
+	}
+
+	for _, c := range changes {
+		fmt.Fprintf(w, "  %s: %s -> %s\n", c.path, c.before, c.after)
+	}
+}
+
+type changedField struct {
+	path   string
+	before string
+	after  string
+}
+
+func toYAMLNode(v interface{}) (*yaml.Node, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	raw, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	return doc.Content[0], nil
+}
+
+func diffNodes(path string, before *yaml.Node, after *yaml.Node) []changedField {
+	if before == nil && after == nil {
+		return nil
+	}
+
+	if before == nil || after == nil || before.Kind != after.Kind || before.Kind != yaml.MappingNode {
+		if nodeValue(before) == nodeValue(after) {
+			return nil
+		}
+		return []changedField{{path: path, before: nodeValue(before), after: nodeValue(after)}}
+	}
+
+	beforeByKey := map[string]*yaml.Node{}
+	afterByKey := map[string]*yaml.Node{}
+	keys := map[string]bool{}
+
+	for i := 0; i+1 < len(before.Content); i += 2 {
+		key := before.Content[i].Value
+		beforeByKey[key] = before.Content[i+1]
+		keys[key] = true
+	}
+	for i := 0; i+1 < len(after.Content); i += 2 {
+		key := after.Content[i].Value
+		afterByKey[key] = after.Content[i+1]
+		keys[key] = true
+	}
+
+	names := make([]string, 0, len(keys))
+	for key := range keys {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	var changes []changedField
+	for _, key := range names {
+		childPath := key
+		if path != "" {
+			childPath = path + "." + key
+		}
+
+		changes = append(changes, diffNodes(childPath, beforeByKey[key], afterByKey[key])...)
+	}
+
+	return changes
+}
+
+func nodeValue(n *yaml.Node) string {
+	if n == nil {
+		return "<none>"
+	}
+	if n.Kind == yaml.ScalarNode {
+		return n.Value
+	}
+
+	out, err := yaml.Marshal(n)
+	if err != nil {
+		return "<unprintable>"
+	}
+
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,76 @@
+package setpipelinehelpers
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffAsEvent(t *testing.T) {
+	d := Diff{
+		Name:   "my-resource",
+		Op:     DiffChanged,
+		Before: map[string]interface{}{"uri": "old"},
+		After:  map[string]interface{}{"uri": "new"},
+	}
+
+	event := d.AsEvent()
+
+	expected := DiffEvent{
+		Name:   "my-resource",
+		Op:     "changed",
+		Before: map[string]interface{}{"uri": "old"},
+		After:  map[string]interface{}{"uri": "new"},
+	}
+
+	if !reflect.DeepEqual(event, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, event)
+	}
+}
+
+func TestAsDiffEvents(t *testing.T) {
+	diffs := []Diff{
+		{Name: "a", Op: DiffAdded, After: "new"},
+		{Name: "b", Op: DiffRemoved, Before: "old"},
+	}
+
+	events := asDiffEvents(diffs)
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	if events[0].Op != "added" || events[1].Op != "removed" {
+		t.Fatalf("unexpected ops: %+v", events)
+	}
+}
+
+func TestRenderOnlyReportsChangedChildKeys(t *testing.T) {
+	d := Diff{
+		Name: "my-resource",
+		Op:   DiffChanged,
+		Before: map[string]interface{}{
+			"source": map[string]interface{}{
+				"uri":    "https://example.com/repo",
+				"branch": "master",
+			},
+		},
+		After: map[string]interface{}{
+			"source": map[string]interface{}{
+				"uri":    "https://example.com/repo",
+				"branch": "main",
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	d.Render(&buf, "resource")
+
+	output := buf.String()
+	if !strings.Contains(output, "source.branch: master -> main") {
+		t.Fatalf("expected output to call out the changed branch key, got:\n%s", output)
+	}
+	if strings.Contains(output, "source.uri") {
+		t.Fatalf("expected output to not mention the unchanged uri key, got:\n%s", output)
+	}
+}
@@ -0,0 +1,160 @@
+package setpipelinehelpers
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	boshtemplate "github.com/cloudfoundry/bosh-cli/director/template"
+)
+
+// SecretProvider resolves template variables from an external source,
+// such as a secret manager or a directory of files, that -v/-l flags
+// don't already cover.
+type SecretProvider interface {
+	Get(name string) (interface{}, bool, error)
+	List() ([]boshtemplate.VariableDefinition, error)
+}
+
+// secretProviderVariables adapts a SecretProvider to the bosh-cli
+// template.Variables interface, recording every successful lookup so
+// --print-used-vars can report which external secrets a pipeline
+// actually referenced.
+type secretProviderVariables struct {
+	provider SecretProvider
+	used     map[string]bool
+}
+
+func newSecretProviderVariables(provider SecretProvider) *secretProviderVariables {
+	return &secretProviderVariables{
+		provider: provider,
+		used:     map[string]bool{},
+	}
+}
+
+func (v *secretProviderVariables) Get(varDef boshtemplate.VariableDefinition) (interface{}, bool, error) {
+	value, found, err := v.provider.Get(varDef.Name)
+	if err != nil || !found {
+		return nil, found, err
+	}
+
+	v.used[varDef.Name] = true
+	return value, true, nil
+}
+
+func (v *secretProviderVariables) List() ([]boshtemplate.VariableDefinition, error) {
+	return v.provider.List()
+}
+
+// UsedVars returns, sorted, the names of every variable the provider
+// actually found; lookups that found nothing are not included.
+func (v *secretProviderVariables) UsedVars() []string {
+	names := make([]string, 0, len(v.used))
+	for name := range v.used {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// CommandSecretProvider resolves a variable by running an external
+// command, with {{.Name}} in CommandTemplate replaced by the requested
+// variable name, e.g. `vault kv get -field=value secret/{{.Name}}`. A
+// non-zero exit is treated as the variable not being found, matching
+// how most secret-manager CLIs report a missing key.
+type CommandSecretProvider struct {
+	CommandTemplate string
+}
+
+func (p CommandSecretProvider) Get(name string) (interface{}, bool, error) {
+	tmpl, err := template.New("vars-from-command").Parse(p.CommandTemplate)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var commandBuf bytes.Buffer
+	err = tmpl.Execute(&commandBuf, struct{ Name string }{name})
+	if err != nil {
+		return nil, false, err
+	}
+
+	cmd := exec.Command("sh", "-c", commandBuf.String())
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return nil, false, nil
+		}
+
+		return nil, false, err
+	}
+
+	return strings.TrimRight(stdout.String(), "\n"), true, nil
+}
+
+func (p CommandSecretProvider) List() ([]boshtemplate.VariableDefinition, error) {
+	// The command is only ever invoked per-variable, so there is no way
+	// to enumerate its keyspace up front.
+	return nil, nil
+}
+
+// DirSecretProvider resolves a variable by reading a file named after
+// it from Dir, a pattern common in GitOps repos that check secrets
+// (often sealed or encrypted) in one file per key.
+type DirSecretProvider struct {
+	Dir string
+}
+
+func (p DirSecretProvider) Get(name string) (interface{}, bool, error) {
+	if !isPlainFileName(name) {
+		return nil, false, fmt.Errorf("invalid variable name %q: must be a plain file name, not a path", name)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(p.Dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+
+		return nil, false, err
+	}
+
+	return strings.TrimRight(string(contents), "\n"), true, nil
+}
+
+// isPlainFileName rejects anything that isn't a single path component,
+// so a ((../../etc/passwd)) or ((sub/dir)) reference in a pipeline
+// can't escape -- or reach into a subdirectory of -- the secrets
+// directory.
+func isPlainFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
+
+func (p DirSecretProvider) List() ([]boshtemplate.VariableDefinition, error) {
+	entries, err := ioutil.ReadDir(p.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	defs := make([]boshtemplate.VariableDefinition, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		defs = append(defs, boshtemplate.VariableDefinition{Name: entry.Name()})
+	}
+
+	return defs, nil
+}
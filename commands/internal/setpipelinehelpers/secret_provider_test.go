@@ -0,0 +1,141 @@
+package setpipelinehelpers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	boshtemplate "github.com/cloudfoundry/bosh-cli/director/template"
+)
+
+func TestDirSecretProviderGet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vars-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "my-var"), []byte("secret-value\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := DirSecretProvider{Dir: dir}
+
+	value, found, err := provider.Get("my-var")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !found || value != "secret-value" {
+		t.Fatalf("expected (\"secret-value\", true), got (%v, %v)", value, found)
+	}
+
+	_, found, err = provider.Get("missing-var")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if found {
+		t.Fatal("expected missing-var to not be found")
+	}
+}
+
+func TestDirSecretProviderGetRejectsPathTraversal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vars-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outside := filepath.Join(filepath.Dir(dir), "outside-secret")
+	if err := ioutil.WriteFile(outside, []byte("should-not-be-readable"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outside)
+
+	provider := DirSecretProvider{Dir: dir}
+
+	for _, name := range []string{
+		"../outside-secret",
+		"../../etc/passwd",
+		"sub/dir",
+		"/etc/passwd",
+		"..",
+	} {
+		_, found, err := provider.Get(name)
+		if err == nil {
+			t.Fatalf("expected an error for variable name %q, got none (found=%v)", name, found)
+		}
+	}
+}
+
+func TestDirSecretProviderList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vars-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("v"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defs, err := DirSecretProvider{Dir: dir}.List()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(defs) != 2 {
+		t.Fatalf("expected 2 variable definitions, got %d", len(defs))
+	}
+}
+
+func TestCommandSecretProviderGet(t *testing.T) {
+	provider := CommandSecretProvider{CommandTemplate: "echo value-for-{{.Name}}"}
+
+	value, found, err := provider.Get("my-var")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !found || value != "value-for-my-var" {
+		t.Fatalf("expected (\"value-for-my-var\", true), got (%v, %v)", value, found)
+	}
+}
+
+func TestCommandSecretProviderGetNotFound(t *testing.T) {
+	provider := CommandSecretProvider{CommandTemplate: "exit 1"}
+
+	_, found, err := provider.Get("my-var")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if found {
+		t.Fatal("expected a non-zero exit to mean not found")
+	}
+}
+
+func TestSecretProviderVariablesTracksUsedVars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vars-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "used"), []byte("v"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	vars := newSecretProviderVariables(DirSecretProvider{Dir: dir})
+
+	if _, _, err := vars.Get(boshtemplate.VariableDefinition{Name: "used"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := vars.Get(boshtemplate.VariableDefinition{Name: "not-used-because-missing"}); err != nil {
+		t.Fatal(err)
+	}
+
+	used := vars.UsedVars()
+	if len(used) != 1 || used[0] != "used" {
+		t.Fatalf("expected only [used], got %v", used)
+	}
+}